@@ -0,0 +1,68 @@
+// Package cache provides a shared, mutex-guarded cache of committed build
+// steps, keyed by the image they started from and a step's own
+// content-derived cache key. It lives below both builder/plan (which owns
+// the stage DAG) and builder/executor's backends (which populate and
+// consult it), so neither has to import the other just to share a cache.
+package cache
+
+import "sync"
+
+// Key identifies a single build step by the image it started from and the
+// step's own cache key.
+type Key struct {
+	Parent string
+	Key    string
+}
+
+// Store is a shared, mutex-guarded cache of committed images, keyed by
+// (parentImageID, cacheKey). Executors running concurrently consult it
+// before rebuilding a step so two stages sharing a base layer reuse one
+// another's work instead of racing to commit it twice.
+type Store struct {
+	mu      sync.Mutex
+	locks   map[Key]*sync.Mutex
+	entries map[Key]string
+}
+
+// NewStore returns an empty, ready-to-use Store.
+func NewStore() *Store {
+	return &Store{
+		locks:   map[Key]*sync.Mutex{},
+		entries: map[Key]string{},
+	}
+}
+
+// Get returns the image ID previously committed for (parent, key), if any.
+func (s *Store) Get(parent, key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.entries[Key{parent, key}]
+	return id, ok
+}
+
+// Put records imageID as the result of building key on top of parent.
+func (s *Store) Put(parent, key, imageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[Key{parent, key}] = imageID
+}
+
+// Lock serializes every caller racing on the same (parent, key) pair, so
+// that a CheckCache-miss-then-Commit sequence for a given step only ever
+// happens once even when several stages reach it at the same time. Callers
+// must invoke the returned func to release the lock.
+func (s *Store) Lock(parent, key string) func() {
+	s.mu.Lock()
+	k := Key{parent, key}
+	l, ok := s.locks[k]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[k] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type cacheSuite struct{}
+
+var _ = Suite(&cacheSuite{})
+
+func TestCache(t *T) {
+	TestingT(t)
+}
+
+func (s *cacheSuite) TestGetPut(c *C) {
+	store := NewStore()
+
+	_, ok := store.Get("parent", "key")
+	c.Assert(ok, Equals, false)
+
+	store.Put("parent", "key", "image-id")
+
+	id, ok := store.Get("parent", "key")
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, "image-id")
+}
+
+// TestLockSerializesConcurrentBuilders simulates several stages racing to
+// build the same (parent, cacheKey) step: each locks, checks for a hit, and
+// -- only on a miss -- does the "build" and commits it to the store before
+// unlocking. Lock must ensure exactly one of them actually builds; every
+// other one blocks until the first has committed, then observes a hit.
+func (s *cacheSuite) TestLockSerializesConcurrentBuilders(c *C) {
+	store := NewStore()
+
+	var builds int32
+	var wg sync.WaitGroup
+
+	const n = 8
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock := store.Lock("parent", "key")
+			defer unlock()
+
+			if _, ok := store.Get("parent", "key"); ok {
+				return
+			}
+
+			atomic.AddInt32(&builds, 1)
+			store.Put("parent", "key", "image-id")
+		}()
+	}
+
+	wg.Wait()
+
+	c.Assert(atomic.LoadInt32(&builds), Equals, int32(1))
+}
@@ -0,0 +1,229 @@
+// Package copier implements buildah-style copy semantics for
+// docker.Docker's CopyToContainer/CopyFromContainer: it walks a source tree
+// honoring .dockerignore, applies --chown/--chmod overrides while building
+// tar headers, preserves xattrs and hardlinks, and guards extraction
+// against path traversal -- matching Dockerfile ADD/COPY behavior instead
+// of the ad-hoc tar assembly those methods used to do by hand.
+package copier
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Options controls how Tar and Untar treat the files they handle.
+type Options struct {
+	// IgnoreFile is the path to a .dockerignore file, relative to Root.
+	// If empty, ".dockerignore" is used when present.
+	IgnoreFile string
+	// Chown, if non-empty, is a "user:group" or "uid:gid" string applied
+	// to every entry, mirroring `COPY --chown`.
+	Chown string
+	// Chmod, if non-nil, overrides the mode of every regular file and
+	// directory, mirroring `COPY --chmod`.
+	Chmod *os.FileMode
+}
+
+// hardlinks tracks device+inode to the first archive path we saw it at, so
+// later copies of the same inode can be written as TypeLink entries instead
+// of being duplicated.
+type hardlinks map[[2]uint64]string
+
+// Tar walks root, matching each of globs against it, and writes the
+// resulting file tree to w as a tar stream honoring .dockerignore and the
+// chown/chmod overrides in opts.
+func Tar(w io.Writer, root string, globs []string, opts Options) error {
+	patterns, err := loadIgnorePatterns(root, opts.IgnoreFile)
+	if err != nil {
+		return err
+	}
+
+	uid, gid, err := opts.resolveChown()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	links := hardlinks{}
+
+	seen := map[string]bool{}
+	for _, glob := range globs {
+		matches, err := filepath.Glob(filepath.Join(root, glob))
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			if err := filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				rel, err := filepath.Rel(root, p)
+				if err != nil {
+					return err
+				}
+
+				if seen[rel] {
+					return nil
+				}
+				seen[rel] = true
+
+				if rel != "." && Ignored(patterns, filepath.ToSlash(rel)) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				return writeEntry(tw, root, p, rel, info, uid, gid, opts.Chmod, links)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeEntry writes a single tar entry for p (rel to root), applying the
+// chown/chmod overrides, preserving xattrs and hardlinks, and rewriting
+// absolute symlink targets so they stay contained within the copy.
+func writeEntry(tw *tar.Writer, root, p, rel string, info os.FileInfo, uid, gid int, chmod *os.FileMode, links hardlinks) error {
+	if rel == "." {
+		return nil
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+
+		if filepath.IsAbs(target) {
+			target = strings.TrimPrefix(target, string(filepath.Separator))
+		}
+
+		link = target
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+
+	if stat, ok := info.Sys().(*unix.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if orig, ok := links[key]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = orig
+			header.Size = 0
+		} else {
+			links[key] = header.Name
+		}
+	}
+
+	if uid >= 0 {
+		header.Uid = uid
+	}
+	if gid >= 0 {
+		header.Gid = gid
+	}
+
+	if chmod != nil {
+		header.Mode = int64(*chmod)
+	}
+
+	if err := writeXattrs(header, p); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeReg {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveChown parses Options.Chown ("user:group" or "uid:gid") into
+// numeric ids, returning -1 for either half left unset.
+func (o Options) resolveChown() (uid, gid int, err error) {
+	if o.Chown == "" {
+		return -1, -1, nil
+	}
+
+	parts := strings.SplitN(o.Chown, ":", 2)
+
+	uid, err = resolveUser(parts[0])
+	if err != nil {
+		return -1, -1, err
+	}
+
+	gid = -1
+	if len(parts) == 2 {
+		gid, err = resolveGroup(parts[1])
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func resolveUser(s string) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+
+	u, err := user.Lookup(s)
+	if err != nil {
+		return -1, fmt.Errorf("could not resolve chown user %q: %v", s, err)
+	}
+
+	return strconv.Atoi(u.Uid)
+}
+
+func resolveGroup(s string) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return -1, fmt.Errorf("could not resolve chown group %q: %v", s, err)
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+func loadIgnorePatterns(root, ignoreFile string) ([]Pattern, error) {
+	if ignoreFile == "" {
+		ignoreFile = filepath.Join(root, ".dockerignore")
+	} else if !filepath.IsAbs(ignoreFile) {
+		ignoreFile = filepath.Join(root, ignoreFile)
+	}
+
+	return ReadIgnoreFile(ignoreFile)
+}
@@ -0,0 +1,83 @@
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *copierSuite) TestTarUntarRoundTrip(c *C) {
+	src, err := ioutil.TempDir("", "box-copier-src")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(src)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644), IsNil)
+	c.Assert(os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")), IsNil)
+	c.Assert(os.Symlink("a.txt", filepath.Join(src, "link.txt")), IsNil)
+
+	var buf bytes.Buffer
+	mode := os.FileMode(0600)
+	c.Assert(Tar(&buf, src, []string{"*"}, Options{Chown: "1234:5678", Chmod: &mode}), IsNil)
+
+	dest, err := ioutil.TempDir("", "box-copier-dest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	c.Assert(Untar(&buf, dest), IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "a.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello")
+
+	linkTarget, err := os.Readlink(filepath.Join(dest, "link.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(linkTarget, Equals, "a.txt")
+
+	fi, err := os.Stat(filepath.Join(dest, "a.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *copierSuite) TestTarHonorsDockerignore(c *C) {
+	src, err := ioutil.TempDir("", "box-copier-src")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(src)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(src, ".dockerignore"), []byte("*.log\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "keep.txt"), []byte("keep"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "drop.log"), []byte("drop"), 0644), IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(Tar(&buf, src, []string{"*"}, Options{}), IsNil)
+
+	names := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[header.Name] = true
+	}
+
+	c.Assert(names["keep.txt"], Equals, true)
+	c.Assert(names["drop.log"], Equals, false)
+}
+
+func (s *copierSuite) TestResolveChownNumeric(c *C) {
+	uid, gid, err := Options{Chown: "1000:2000"}.resolveChown()
+	c.Assert(err, IsNil)
+	c.Assert(uid, Equals, 1000)
+	c.Assert(gid, Equals, 2000)
+}
+
+func (s *copierSuite) TestResolveChownUserOnly(c *C) {
+	uid, gid, err := Options{Chown: "1000"}.resolveChown()
+	c.Assert(err, IsNil)
+	c.Assert(uid, Equals, 1000)
+	c.Assert(gid, Equals, -1)
+}
@@ -0,0 +1,107 @@
+package copier
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Pattern is a single line of a .dockerignore file: a slash-separated glob,
+// optionally negated with a leading "!".
+type Pattern struct {
+	Glob   string
+	Negate bool
+}
+
+// ReadIgnoreFile parses the .dockerignore file at name. A missing file is
+// not an error -- it simply means there are no patterns.
+func ReadIgnoreFile(name string) ([]Pattern, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseIgnoreFile(f)
+}
+
+// ParseIgnoreFile parses .dockerignore syntax from r: one glob per line,
+// blank lines and "#" comments ignored, "!" negates a prior exclusion.
+func ParseIgnoreFile(r io.Reader) ([]Pattern, error) {
+	var patterns []Pattern
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		negate := false
+		if strings.HasPrefix(line, "!") {
+			negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		patterns = append(patterns, Pattern{Glob: path.Clean(line), Negate: negate})
+	}
+
+	return patterns, scanner.Err()
+}
+
+// Ignored reports whether rel (a slash-separated path relative to the copy
+// root) is excluded by patterns. Later patterns take precedence over
+// earlier ones, matching dockerignore's "last match wins" semantics.
+func Ignored(patterns []Pattern, rel string) bool {
+	rel = path.Clean(rel)
+
+	ignored := false
+	for _, p := range patterns {
+		if matchGlob(p.Glob, rel) {
+			ignored = !p.Negate
+		}
+	}
+
+	return ignored
+}
+
+// matchGlob matches a dockerignore-style glob against a slash-separated
+// path, supporting "**" to match any number of path segments in addition to
+// the usual single-segment "*"/"?" wildcards.
+func matchGlob(glob, name string) bool {
+	return matchSegments(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(glob, name []string) bool {
+	if len(glob) == 0 {
+		return len(name) == 0
+	}
+
+	if glob[0] == "**" {
+		if matchSegments(glob[1:], name) {
+			return true
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		return matchSegments(glob, name[1:])
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(glob[0], name[0])
+	if err != nil || !ok {
+		return false
+	}
+
+	return matchSegments(glob[1:], name[1:])
+}
@@ -0,0 +1,53 @@
+package copier
+
+import (
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type copierSuite struct{}
+
+var _ = Suite(&copierSuite{})
+
+func TestCopier(t *T) {
+	TestingT(t)
+}
+
+func (s *copierSuite) TestParseIgnoreFile(c *C) {
+	patterns, err := ParseIgnoreFile(strings.NewReader(`
+# comment
+*.log
+
+!keep.log
+vendor/**
+`))
+	c.Assert(err, IsNil)
+	c.Assert(patterns, HasLen, 3)
+	c.Assert(patterns[0], Equals, Pattern{Glob: "*.log", Negate: false})
+	c.Assert(patterns[1], Equals, Pattern{Glob: "keep.log", Negate: true})
+	c.Assert(patterns[2], Equals, Pattern{Glob: "vendor/**", Negate: false})
+}
+
+func (s *copierSuite) TestIgnored(c *C) {
+	patterns := []Pattern{
+		{Glob: "*.log"},
+		{Glob: "keep.log", Negate: true},
+		{Glob: "vendor/**"},
+	}
+
+	table := []struct {
+		path   string
+		result bool
+	}{
+		{"debug.log", true},
+		{"keep.log", false},
+		{"vendor/foo/bar.go", true},
+		{"main.go", false},
+	}
+
+	for _, t := range table {
+		c.Assert(Ignored(patterns, t.path), Equals, t.result, Commentf("path: %s", t.path))
+	}
+}
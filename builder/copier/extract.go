@@ -0,0 +1,149 @@
+package copier
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// whiteoutPrefix marks a deleted file in an overlay-style layer diff, the
+// same convention aufs/overlay layer tars use.
+const whiteoutPrefix = ".wh."
+
+// Untar extracts the tar stream r into dest, refusing any entry whose name or
+// relative symlink target would escape dest via "..", rewriting absolute
+// symlink targets to point inside dest, and translating
+// ".wh.*" whiteout entries into real overlayfs whiteout devices rather than
+// extracting them as regular files.
+func Untar(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		target, err := containedPath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(target)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteout := filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix))
+			if err := writeWhiteout(whiteout); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, header, target, dest); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry writes a single non-whiteout tar entry to target.
+func extractEntry(tr *tar.Reader, header *tar.Header, target, dest string) error {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		f.Close()
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		linkname := header.Linkname
+		if filepath.IsAbs(linkname) {
+			// Contain the symlink within dest instead of letting it
+			// point at an absolute host path.
+			linkname = filepath.Join(dest, filepath.Clean(linkname))
+		} else if err := verifyContained(dest, filepath.Join(filepath.Dir(target), linkname)); err != nil {
+			// A relative target is resolved from the symlink's own
+			// directory, not dest itself -- ".." components can still
+			// walk it outside dest, so check the resolved path.
+			return err
+		}
+
+		os.Remove(target)
+		if err := os.Symlink(linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		oldTarget, err := containedPath(dest, header.Linkname)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(target)
+		if err := os.Link(oldTarget, target); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	restoreXattrs(header, target)
+
+	return nil
+}
+
+// containedPath joins name onto dest and verifies the result does not
+// escape dest, guarding against ".." path traversal (a.k.a. zip-slip) in
+// tar entry names.
+func containedPath(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	return target, verifyContained(dest, target)
+}
+
+// verifyContained returns an error if the already-resolved, absolute path
+// is not dest itself or a descendant of it.
+func verifyContained(dest, path string) error {
+	if path != dest && !strings.HasPrefix(path, dest+string(filepath.Separator)) {
+		return fmt.Errorf("path %q escapes destination %q", path, dest)
+	}
+
+	return nil
+}
+
+// writeWhiteout replaces path with an overlayfs whiteout: a character
+// device with major/minor 0/0, the kernel's marker for "this file is
+// deleted in the upper layer".
+func writeWhiteout(path string) error {
+	os.RemoveAll(path)
+	return unix.Mknod(path, unix.S_IFCHR, 0)
+}
@@ -0,0 +1,103 @@
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func writeTarHeader(tw *tar.Writer, header *tar.Header, content string) error {
+	header.Size = int64(len(content))
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write([]byte(content))
+	return err
+}
+
+func (s *copierSuite) TestUntarRefusesDotDotTraversal(c *C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	c.Assert(writeTarHeader(tw, &tar.Header{
+		Name:     "../../etc/passwd",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}, "pwned"), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	dest, err := ioutil.TempDir("", "box-extract-dest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	c.Assert(Untar(&buf, dest), NotNil)
+}
+
+func (s *copierSuite) TestUntarContainsAbsoluteSymlink(c *C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	c.Assert(tw.WriteHeader(&tar.Header{
+		Name:     "evil",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "/etc/passwd",
+		Mode:     0777,
+	}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	dest, err := ioutil.TempDir("", "box-extract-dest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	c.Assert(Untar(&buf, dest), IsNil)
+
+	target, err := os.Readlink(filepath.Join(dest, "evil"))
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, filepath.Join(dest, "/etc/passwd"))
+}
+
+func (s *copierSuite) TestUntarRefusesRelativeSymlinkEscape(c *C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	c.Assert(tw.WriteHeader(&tar.Header{
+		Name:     "sub/evil",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "../../../etc/passwd",
+		Mode:     0777,
+	}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	dest, err := ioutil.TempDir("", "box-extract-dest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	c.Assert(Untar(&buf, dest), NotNil)
+}
+
+func (s *copierSuite) TestUntarWhiteout(c *C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	c.Assert(writeTarHeader(tw, &tar.Header{
+		Name:     "keep.txt",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}, "keep"), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{
+		Name:     ".wh.keep.txt",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	dest, err := ioutil.TempDir("", "box-extract-dest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	c.Assert(Untar(&buf, dest), IsNil)
+
+	fi, err := os.Lstat(filepath.Join(dest, "keep.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode()&os.ModeCharDevice, Equals, os.ModeCharDevice)
+}
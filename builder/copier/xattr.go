@@ -0,0 +1,81 @@
+package copier
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrPrefix is how tar conventionally stores extended attributes in the
+// PAX record namespace (the same scheme GNU tar and Docker's own archive
+// code use), so consumers that understand SCHILY.xattr.* can restore them.
+const xattrPrefix = "SCHILY.xattr."
+
+// writeXattrs reads the extended attributes of p and records them as PAX
+// records on header.
+func writeXattrs(header *tar.Header, p string) error {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size <= 0 {
+		// ENOTSUP/EOPNOTSUPP are common on filesystems without xattr
+		// support; treat every listing failure as "no xattrs".
+		return nil
+	}
+
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+
+	for _, name := range splitNullTerminated(buf[:n]) {
+		if name == "" {
+			continue
+		}
+
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil || vsize <= 0 {
+			continue
+		}
+
+		val := make([]byte, vsize)
+		vn, err := unix.Lgetxattr(p, name, val)
+		if err != nil {
+			continue
+		}
+
+		header.PAXRecords[xattrPrefix+name] = string(val[:vn])
+	}
+
+	return nil
+}
+
+// restoreXattrs applies any SCHILY.xattr.* PAX records back onto the file
+// written at p.
+func restoreXattrs(header *tar.Header, p string) {
+	for key, val := range header.PAXRecords {
+		if len(key) <= len(xattrPrefix) || key[:len(xattrPrefix)] != xattrPrefix {
+			continue
+		}
+
+		name := key[len(xattrPrefix):]
+		unix.Lsetxattr(p, name, []byte(val), 0)
+	}
+}
+
+func splitNullTerminated(buf []byte) []string {
+	var names []string
+
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			names = append(names, string(buf[start:i]))
+			start = i + 1
+		}
+	}
+
+	return names
+}
@@ -3,8 +3,8 @@ package docker
 import (
 	"archive/tar"
 	"bufio"
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"syscall"
 	"time"
@@ -20,6 +21,7 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/docker/pkg/term"
+	"github.com/erikh/box/builder/cache"
 	"github.com/erikh/box/builder/config"
 	"github.com/erikh/box/builder/executor"
 	"github.com/erikh/box/log"
@@ -28,11 +30,20 @@ import (
 
 // Docker implements an executor that talks to docker to achieve its goals.
 type Docker struct {
-	client   *client.Client
-	config   *config.Config
-	useCache bool
-	tty      bool
-	stdin    bool
+	client     *client.Client
+	config     *config.Config
+	useCache   bool
+	tty        bool
+	stdin      bool
+	cacheStore *cache.Store
+
+	// cacheUnlock releases cacheStore's lock for the in-flight cache key
+	// once CheckCache has returned a miss. It is set by CheckCache and
+	// must be released by the Commit call that follows, so the whole
+	// check-then-build-then-commit sequence for a given (parent,
+	// cacheKey) pair only ever runs once even when sibling stages race
+	// on it concurrently.
+	cacheUnlock func()
 }
 
 // NewDocker constructs a new docker instance, for executing against docker
@@ -73,6 +84,13 @@ func (d *Docker) UseTTY(arg bool) {
 	d.tty = arg
 }
 
+// UseCacheStore points CheckCache/Commit at a shared cache.Store, so that
+// concurrently running build stages which share a parent image reuse one
+// another's committed steps instead of racing to rebuild and recommit them.
+func (d *Docker) UseCacheStore(store *cache.Store) {
+	d.cacheStore = store
+}
+
 // LoadConfig loads the configuration into the executor.
 func (d *Docker) LoadConfig(c *config.Config) error {
 	d.config = c
@@ -84,8 +102,31 @@ func (d *Docker) Config() *config.Config {
 	return d.config
 }
 
+// Clone returns a new Docker executor sharing this one's client connection
+// but with its own copy of the configuration, so a build stage can proceed
+// independently of its siblings without clobbering their in-progress image
+// state.
+func (d *Docker) Clone() (executor.Executor, error) {
+	return &Docker{
+		client:     d.client,
+		config:     d.config.Clone(),
+		useCache:   d.useCache,
+		tty:        d.tty,
+		stdin:      d.stdin,
+		cacheStore: d.cacheStore,
+	}, nil
+}
+
 // Commit commits an entry to the layer list.
 func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
+	parent := d.config.Image
+
+	if d.cacheUnlock != nil {
+		unlock := d.cacheUnlock
+		d.cacheUnlock = nil
+		defer unlock()
+	}
+
 	id, err := d.Create()
 	if err != nil {
 		return err
@@ -130,6 +171,10 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 
 	d.config.Image = commitResp.ID
 
+	if d.cacheStore != nil {
+		d.cacheStore.Put(parent, cacheKey, commitResp.ID)
+	}
+
 	return nil
 }
 
@@ -141,9 +186,28 @@ func (d *Docker) CheckCache(cacheKey string) (bool, error) {
 		return false, nil
 	}
 
+	// Lock before consulting cacheStore and hold the lock across a miss,
+	// releasing it only once Commit (which must follow) has recorded the
+	// step's result -- otherwise two stages racing on the same (parent,
+	// cacheKey) both observe a miss and both rebuild.
+	var unlock func()
+	if d.cacheStore != nil {
+		unlock = d.cacheStore.Lock(d.config.Image, cacheKey)
+
+		if id, ok := d.cacheStore.Get(d.config.Image, cacheKey); ok {
+			unlock()
+			log.CacheHit(id)
+			d.config.Image = id
+			return true, nil
+		}
+	}
+
 	if d.config.Image != "" {
 		images, err := d.client.ImageList(context.Background(), types.ImageListOptions{All: true})
 		if err != nil {
+			if unlock != nil {
+				unlock()
+			}
 			return false, err
 		}
 
@@ -151,12 +215,24 @@ func (d *Docker) CheckCache(cacheKey string) (bool, error) {
 			if img.ParentID == d.config.Image {
 				inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), img.ID)
 				if err != nil {
+					if unlock != nil {
+						unlock()
+					}
 					return false, err
 				}
 
 				if inspect.Comment == cacheKey {
+					if unlock != nil {
+						unlock()
+					}
+
 					log.CacheHit(img.ID)
 					d.config.FromDocker(inspect.Config)
+
+					if d.cacheStore != nil {
+						d.cacheStore.Put(d.config.Image, cacheKey, img.ID)
+					}
+
 					d.config.Image = img.ID
 					return true, nil
 				}
@@ -164,6 +240,8 @@ func (d *Docker) CheckCache(cacheKey string) (bool, error) {
 		}
 	}
 
+	d.cacheUnlock = unlock
+
 	return false, nil
 }
 
@@ -235,230 +313,129 @@ func (d *Docker) CopyFromContainer(id, path string) (io.Reader, int64, error) {
 }
 
 // CopyToContainer copies a tarred up series of files (passed in through the
-// io.Reader handle) to the container where they are untarred.
-func (d *Docker) CopyToContainer(id string, size int64, tw io.Reader) error {
-	tf, err := ioutil.TempFile("", "box-temporary-layer")
+// io.Reader handle) into a new layer on top of the current image. It builds
+// a valid `docker load` stream -- a <layerID>/layer.tar payload, the
+// corresponding <layerID>/json v1 metadata, a top-level image config blob
+// with the new layer's DiffID appended to the parent's rootfs.diff_ids, and
+// a manifest.json tying them together -- and streams it straight into
+// client.ImageLoad. The resulting image is therefore a proper child layer
+// of the current one and can be fed back into Commit.
+func (d *Docker) CopyToContainer(id string, size int64, tr io.Reader) error {
+	layerContent, err := ioutil.ReadAll(tr)
 	if err != nil {
 		return err
 	}
 
-	defer tf.Close() // second close is fine here
-	defer os.Remove(tf.Name())
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layerContent))
+	layerID := fmt.Sprintf("%x", sha256.Sum256([]byte(d.config.Image+diffID)))
 
-	if _, err := io.Copy(tf, tw); err != nil {
+	diffIDs := append(append([]string{}, d.config.DiffIDs...), diffID)
+	image := d.config.ToImage(diffIDs)
+
+	imageContent, err := json.Marshal(image)
+	if err != nil {
 		return err
 	}
 
-	tf.Close()
-
-	errChan := make(chan error)
+	imageDigestHex := fmt.Sprintf("%x", sha256.Sum256(imageContent))
+	imageID := "sha256:" + imageDigestHex
 
-	copyID := id
-	jsonFile := fmt.Sprintf("%s.json", copyID)
-	tarFile := fmt.Sprintf("%s/layer.tar", copyID)
-
-	repos := map[string]map[string]string{
-		copyID: {"latest": copyID},
+	v1Content, err := json.Marshal(map[string]interface{}{
+		"id":      layerID,
+		"parent":  d.config.Image,
+		"created": time.Now().Format(time.RFC3339Nano),
+		"config":  d.config.ToDocker(d.tty, d.stdin),
+	})
+	if err != nil {
+		return err
 	}
 
-	manifest := []map[string]interface{}{{
-		"Config":   jsonFile,
-		"RepoTags": []string{copyID},
-		"Layers":   []string{tarFile},
-	}}
-
-	image := d.config.ToImage([]string{copyID})
+	manifestContent, err := json.Marshal([]map[string]interface{}{{
+		"Config":   imageDigestHex + ".json",
+		"RepoTags": []string{},
+		"Layers":   []string{path.Join(layerID, "layer.tar")},
+	}})
+	if err != nil {
+		return err
+	}
 
 	r, w := io.Pipe()
-	r2 := io.TeeReader(r, w)
-	go func(r io.Reader) {
-		f, err := os.Create("test")
 
-		if err != nil {
-			panic(err)
-		}
-
-		fmt.Println(io.Copy(f, r))
-	}(r2)
+	go func() {
+		tw := tar.NewWriter(w)
 
-	go func(r io.ReadCloser) {
-		io.Copy(os.Stdout, r)
-		rc, err := d.client.ImageImport(context.Background(), types.ImageImportSource{Source: r}, "box-"+copyID, types.ImageImportOptions{})
-		if err == nil {
-			// FIXME workaround for a client issue. Fix this in docker.
-			content, err := ioutil.ReadAll(rc)
-			if err != nil {
-				errChan <- err
-				return
+		w.CloseWithError(func() error {
+			if err := writeTarEntry(tw, imageDigestHex+".json", imageContent); err != nil {
+				return err
 			}
 
-			lines := bytes.Split(content, []byte("\r\n"))
-			for _, line := range lines {
-				result := map[string]interface{}{}
-				fmt.Println("line:", string(line))
-
-				if err := json.Unmarshal(line, &result); err != nil {
-					errChan <- err
-					return
-				}
-
-				if res, ok := result["error"].(string); ok {
-					errChan <- errors.New(res)
-					return
-				}
+			if err := writeTarEntry(tw, path.Join(layerID, "json"), v1Content); err != nil {
+				return err
 			}
-		}
-
-		errChan <- err
-	}(r)
-
-	imgwriter := tar.NewWriter(w)
-
-	content, err := json.Marshal(image)
-	if err != nil {
-		return err
-	}
-
-	err = imgwriter.WriteHeader(&tar.Header{
-		Uname:      "root",
-		Gname:      "root",
-		Name:       jsonFile,
-		Linkname:   jsonFile,
-		Size:       int64(len(content)),
-		Mode:       0666,
-		Typeflag:   tar.TypeReg,
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
-	})
 
-	if err != nil {
-		fmt.Println("here")
-		return err
-	}
-
-	if _, err := imgwriter.Write(content); err != nil {
-		fmt.Println("here")
-		return err
-	}
+			if err := writeTarEntry(tw, path.Join(layerID, "layer.tar"), layerContent); err != nil {
+				return err
+			}
 
-	content, err = json.Marshal(repos)
-	if err != nil {
-		return err
-	}
+			if err := writeTarEntry(tw, "manifest.json", manifestContent); err != nil {
+				return err
+			}
 
-	err = imgwriter.WriteHeader(&tar.Header{
-		Name:       "repositories",
-		Linkname:   "repositories",
-		Uname:      "root",
-		Gname:      "root",
-		Size:       int64(len(content)),
-		Mode:       0666,
-		Typeflag:   tar.TypeReg,
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
-	})
+			return tw.Close()
+		}())
+	}()
 
+	resp, err := d.client.ImageLoad(context.Background(), r, true)
 	if err != nil {
-		fmt.Println("here")
 		return err
 	}
+	defer resp.Body.Close()
 
-	if _, err := imgwriter.Write(content); err != nil {
-		fmt.Println("here")
+	if err := checkLoadResponse(resp.Body); err != nil {
 		return err
 	}
 
-	content, err = json.Marshal(manifest)
-	if err != nil {
-		return err
-	}
+	d.config.Image = imageID
+	d.config.DiffIDs = diffIDs
 
-	err = imgwriter.WriteHeader(&tar.Header{
-		Name:       "manifest.json",
-		Linkname:   "manifest.json",
-		Uname:      "root",
-		Gname:      "root",
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
-		Size:       int64(len(content)),
-		Mode:       0666,
-		Typeflag:   tar.TypeReg,
-	})
-
-	if err != nil {
-		fmt.Println("here")
-		return err
-	}
+	return nil
+}
 
-	if _, err := imgwriter.Write(content); err != nil {
-		fmt.Println("here")
+// writeTarEntry writes a single regular file entry to tw.
+func writeTarEntry(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Uname:    "root",
+		Gname:    "root",
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}); err != nil {
 		return err
 	}
 
-	imgwriter.Close()
-	w.Close()
+	_, err := tw.Write(content)
+	return err
+}
 
-	/*
-		fi, err := os.Stat(tf.Name())
-		if err != nil {
-			cancel()
-			errChan <- err
-			return
+// checkLoadResponse scans the newline-delimited JSON progress stream
+// returned by ImageLoad for an "error" field, since the client otherwise
+// reports a load as successful even when the daemon rejected it.
+func checkLoadResponse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var result map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
 		}
 
-		err = imgwriter.WriteHeader(&tar.Header{
-			Name:     copyID,
-			Mode:     0777,
-			Typeflag: tar.TypeDir,
-		})
-
-		if err != nil {
-			cancel()
-			errChan <- err
-			return
+		if msg, ok := result["error"].(string); ok {
+			return errors.New(msg)
 		}
-
-			err = imgwriter.WriteHeader(&tar.Header{
-				Name:     tarFile,
-				Size:     fi.Size(),
-				Mode:     0666,
-				Typeflag: tar.TypeReg,
-			})
-
-			if err != nil {
-				cancel()
-				errChan <- err
-				return
-			}
-
-			tr, err := os.Open(tf.Name())
-			if err != nil {
-				cancel()
-				errChan <- err
-				return
-			}
-
-			defer tr.Close()
-
-			x, err := io.Copy(imgwriter, tr)
-			fmt.Println(x, err)
-			if err != nil {
-				cancel()
-				errChan <- err
-				return
-			}
-	*/
-
-	if err := <-errChan; err != nil {
-		return err
 	}
 
-	d.config.Image = copyID
-
-	return nil
+	return scanner.Err()
 }
 
 // Tag an image with the provided string.
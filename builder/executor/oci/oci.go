@@ -0,0 +1,672 @@
+// Package oci implements a daemonless executor.Executor backend. Instead of
+// talking to a docker daemon, it stages each build step in an overlayfs
+// upperdir (via layer.Filesystem), runs the step with runc inside the
+// resulting rootfs, and snapshots the upperdir as a content-addressed tar
+// layer. The accumulated layers are assembled into an OCI image layout that
+// Tag writes to a local directory; this package does not push images to a
+// registry.
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/erikh/box/builder/cache"
+	"github.com/erikh/box/builder/config"
+	"github.com/erikh/box/builder/copier"
+	"github.com/erikh/box/builder/executor"
+	"github.com/erikh/box/layer"
+)
+
+// diffID is the sha256 digest of an uncompressed layer tar, used both as the
+// cache key and as the rootfs.diff_ids entry in the image config.
+type diffID string
+
+// cacheEntry records a previously committed layer so that CheckCache can
+// short-circuit identical build steps.
+type cacheEntry struct {
+	parent   string
+	cacheKey string
+	layer    diffID
+}
+
+// OCI is an executor.Executor that builds images natively, without a docker
+// daemon. Each step is staged under root in its own overlay upperdir and
+// executed with runc.
+type OCI struct {
+	root     string
+	imageDir string
+	config   *config.Config
+	useCache bool
+	tty      bool
+	stdin    bool
+
+	// baseLayer is a permanent, empty lowerdir. layer.Filesystem.Mount
+	// refuses an overlay with fewer than two layers, so the very first
+	// build step -- which has no committed layers of its own yet -- still
+	// needs a real lowerdir to mount against.
+	baseLayer *layer.Layer
+
+	mu sync.Mutex
+
+	// committedLayers holds, in order, the *layer.Layer for every step
+	// already committed. Each one remembers the root it was created
+	// under, so a Clone can keep building on top of its parent's chain
+	// without copying the parent's layer directories onto disk: the
+	// parent's layers are read-only lowerdirs from this point on, so
+	// sharing the *layer.Layer is enough.
+	committedLayers []*layer.Layer
+	diffIDs         []diffID
+	cache           []cacheEntry
+	cacheStore      *cache.Store
+
+	// cacheUnlock releases cacheStore's lock for the in-flight cache key
+	// once CheckCache has returned a miss. It is set by CheckCache and
+	// must be released by the Commit call that follows, so the whole
+	// check-then-build-then-commit sequence for a given (parent,
+	// cacheKey) pair only ever runs once even when sibling stages race
+	// on it concurrently.
+	cacheUnlock func()
+
+	mounts  map[string]*layer.Filesystem // mountpoint -> the Filesystem mounted there
+	current string                       // dirname of the layer currently mounted by Create
+}
+
+// NewOCI constructs an OCI executor. root is a scratch directory used to
+// stage layer overlays; imageDir is where the final OCI image layout
+// (oci-layout, index.json, blobs/) is written.
+func NewOCI(useCache, tty bool, root, imageDir string) (*OCI, error) {
+	if root == "" {
+		return nil, fmt.Errorf("root may not be empty")
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	baseLayer, err := layer.New("layer-0", root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !baseLayer.Exists() {
+		if err := baseLayer.Create(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &OCI{
+		root:      root,
+		imageDir:  imageDir,
+		tty:       tty,
+		useCache:  useCache,
+		config:    config.NewConfig(),
+		baseLayer: baseLayer,
+		mounts:    map[string]*layer.Filesystem{},
+	}, nil
+}
+
+// SetStdin turns on the stdin features during run invocations.
+func (o *OCI) SetStdin(on bool) {
+	o.stdin = on
+}
+
+// ImageID returns the digest of the most recently committed layer.
+func (o *OCI) ImageID() string {
+	return o.config.Image
+}
+
+// UseCache determines if the cache should be considered or not.
+func (o *OCI) UseCache(arg bool) {
+	o.useCache = arg
+}
+
+// UseTTY determines whether or not to allocate a pty for run operations.
+func (o *OCI) UseTTY(arg bool) {
+	o.tty = arg
+}
+
+// UseCacheStore points CheckCache/Commit at a shared cache.Store, so that
+// concurrently running build stages which share a parent layer reuse one
+// another's committed steps instead of racing to rebuild and recommit them.
+func (o *OCI) UseCacheStore(store *cache.Store) {
+	o.cacheStore = store
+}
+
+// LoadConfig loads the configuration into the executor.
+func (o *OCI) LoadConfig(c *config.Config) error {
+	o.config = c
+	return nil
+}
+
+// Config returns the current *Config for the executor.
+func (o *OCI) Config() *config.Config {
+	return o.config
+}
+
+// Clone returns a new OCI executor that stages new layers under a sibling
+// scratch directory but writes to the same final imageDir, so a build stage
+// can proceed independently of its siblings without their overlay mounts
+// colliding. It carries over the committed layer chain (and the cache
+// bookkeeping keyed to it) so the clone keeps building on top of this
+// executor's current image instead of starting over from an empty rootfs.
+func (o *OCI) Clone() (executor.Executor, error) {
+	root, err := ioutil.TempDir(filepath.Dir(o.root), "box-oci-stage")
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	committedLayers := append([]*layer.Layer{}, o.committedLayers...)
+	diffIDs := append([]diffID{}, o.diffIDs...)
+	cacheEntries := append([]cacheEntry{}, o.cache...)
+	o.mu.Unlock()
+
+	return &OCI{
+		root:            root,
+		imageDir:        o.imageDir,
+		config:          o.config.Clone(),
+		useCache:        o.useCache,
+		tty:             o.tty,
+		stdin:           o.stdin,
+		baseLayer:       o.baseLayer,
+		committedLayers: committedLayers,
+		diffIDs:         diffIDs,
+		cache:           cacheEntries,
+		cacheStore:      o.cacheStore,
+		mounts:          map[string]*layer.Filesystem{},
+	}, nil
+}
+
+// layerDir returns the scratch directory for the nth new layer, relative to
+// this executor's own root. Already-committed layers are tracked directly
+// via committedLayers, each remembering the root it was actually created
+// under (which may be a different executor's root, after Clone).
+func (o *OCI) layerDir(n int) string {
+	return filepath.Join(o.root, fmt.Sprintf("layer-%d", n))
+}
+
+// runcRoot returns this executor's private runc state directory, creating
+// it if necessary. Every OCI instance (including each clone produced by
+// Clone) has its own root, so scoping runc's --root here keeps container
+// ids from colliding across independently-running build stages.
+func (o *OCI) runcRoot() (string, error) {
+	dir := filepath.Join(o.root, "runc")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// blobsDir returns where layer/config blobs are written as they're
+// produced. If imageDir hasn't been configured, a scratch location under
+// root is used instead; Tag (via writeIndex) requires imageDir to finalize
+// the image layout.
+func (o *OCI) blobsDir() string {
+	if o.imageDir != "" {
+		return filepath.Join(o.imageDir, "blobs", "sha256")
+	}
+
+	return filepath.Join(o.root, "blobs", "sha256")
+}
+
+// stageFilesystem assembles a layer.Filesystem whose lowerdirs are the
+// empty base layer plus every previously committed layer, and whose
+// upperdir is a fresh directory for the step about to run. The base layer
+// guarantees at least two layers are ever handed to layer.Filesystem.Mount,
+// which otherwise rejects a single-layer overlay (no lowerdir at all) --
+// exactly the case the very first build step would hit.
+func (o *OCI) stageFilesystem() (*layer.Filesystem, string, error) {
+	n := len(o.committedLayers)
+
+	layers := append([]*layer.Layer{o.baseLayer}, o.committedLayers...)
+
+	upper, err := layer.New(filepath.Base(o.layerDir(n+1)), o.root)
+	if err != nil {
+		return nil, "", err
+	}
+	layers = append(layers, upper)
+
+	mountpoint := filepath.Join(o.root, fmt.Sprintf("mnt-%d", n))
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return nil, "", err
+	}
+
+	fs := &layer.Filesystem{Layers: layers, Mountpoint: mountpoint}
+	work := filepath.Join(o.root, fmt.Sprintf("work-%d", n))
+
+	if err := fs.Mount(work); err != nil {
+		return nil, "", err
+	}
+
+	return fs, mountpoint, nil
+}
+
+// Create stages a fresh overlay rootfs and returns its mountpoint, which
+// stands in for a container id in this executor.
+func (o *OCI) Create() (string, error) {
+	fs, mountpoint, err := o.stageFilesystem()
+	if err != nil {
+		return "", err
+	}
+
+	o.mu.Lock()
+	o.mounts[mountpoint] = fs
+	o.mu.Unlock()
+
+	o.current = mountpoint
+	return mountpoint, nil
+}
+
+// Destroy unmounts the overlay rootfs for the given mountpoint -- tearing
+// down the fuse-overlayfs process if that's what backed it -- and then
+// removes the (now bare) mountpoint directory.
+func (o *OCI) Destroy(id string) error {
+	o.mu.Lock()
+	fs, ok := o.mounts[id]
+	delete(o.mounts, id)
+	o.mu.Unlock()
+
+	if ok {
+		if err := fs.Unmount(); err != nil {
+			return fmt.Errorf("could not unmount %q: %v", id, err)
+		}
+	}
+
+	return os.RemoveAll(id)
+}
+
+// RunHook executes the current command inside the staged rootfs via runc.
+func (o *OCI) RunHook(id string) (string, error) {
+	bundle, err := o.writeRuncBundle(id)
+	if err != nil {
+		return "", err
+	}
+
+	runcRoot, err := o.runcRoot()
+	if err != nil {
+		return "", err
+	}
+
+	// filepath.Base(id) (e.g. "mnt-0") is only unique within this
+	// executor's own root: Runner.Run clones the same base OCI executor
+	// for every independent stage, so two stages' first steps both
+	// compute "mnt-0" and would collide in runc's default (shared) state
+	// root. Scoping --root to this executor's own root keeps every
+	// clone's container ids in a separate namespace.
+	cmd := exec.CommandContext(context.Background(), "runc", "--root", runcRoot, "run", "-b", bundle, filepath.Base(id))
+	if o.stdin {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("runc run failed for %q: %v", id, err)
+	}
+
+	return "", nil
+}
+
+// writeRuncBundle renders a minimal OCI runtime bundle (config.json) for the
+// rootfs at id, translating the box config's Cmd/Env/WorkingDir.
+func (o *OCI) writeRuncBundle(id string) (string, error) {
+	bundle := filepath.Join(o.root, "bundle-"+filepath.Base(id))
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return "", err
+	}
+
+	spec := o.config.ToRuntimeSpec(id, o.tty, o.stdin)
+
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, "config.json"), content, 0644); err != nil {
+		return "", err
+	}
+
+	return bundle, nil
+}
+
+// Commit snapshots the upperdir of the most recently staged layer as a new
+// tar layer, rolls it into the running diff_id chain, and records it in the
+// content-addressable cache under cacheKey.
+func (o *OCI) Commit(cacheKey string, hook executor.Hook) error {
+	parent := o.config.Image
+
+	if o.cacheUnlock != nil {
+		unlock := o.cacheUnlock
+		o.cacheUnlock = nil
+		defer unlock()
+	}
+
+	id, err := o.Create()
+	if err != nil {
+		return err
+	}
+	defer o.Destroy(id)
+
+	if hook != nil {
+		tmp, err := hook(id)
+		if err != nil {
+			return err
+		}
+
+		if tmp != "" {
+			cacheKey = tmp
+		}
+	}
+
+	upper := o.layerDir(len(o.committedLayers) + 1)
+
+	upperLayer, err := layer.New(filepath.Base(upper), o.root)
+	if err != nil {
+		return err
+	}
+
+	digest, err := o.tarLayer(upper)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.committedLayers = append(o.committedLayers, upperLayer)
+	o.diffIDs = append(o.diffIDs, digest)
+	o.cache = append(o.cache, cacheEntry{parent: parent, cacheKey: cacheKey, layer: digest})
+	o.mu.Unlock()
+
+	o.config.Image = string(digest)
+
+	if o.cacheStore != nil {
+		o.cacheStore.Put(parent, cacheKey, string(digest))
+	}
+
+	return nil
+}
+
+// tarLayer walks dir, uncompressed-tars its contents straight into the
+// image's blob store (content-addressed by the tar's own sha256 digest),
+// and returns that digest -- the layer's DiffID, matching the OCI/docker
+// definition.
+func (o *OCI) tarLayer(dir string) (diffID, error) {
+	blobs := o.blobsDir()
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(blobs, "layer-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed below; cleans up on error
+
+	h := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(tmp, h))
+
+	walkErr := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if walkErr != nil {
+		tmp.Close()
+		return "", walkErr
+	}
+
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	digest := diffID(hex.EncodeToString(h.Sum(nil)))
+
+	if err := os.Rename(tmp.Name(), filepath.Join(blobs, string(digest))); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// CheckCache consults the content-addressable cache and returns true if a
+// layer was previously committed for the current parent image and cacheKey.
+func (o *OCI) CheckCache(cacheKey string) (bool, error) {
+	if !o.useCache {
+		return false, nil
+	}
+
+	// Lock before consulting cacheStore and hold the lock across a miss,
+	// releasing it only once Commit (which must follow) has recorded the
+	// step's result -- otherwise two stages racing on the same (parent,
+	// cacheKey) both observe a miss and both rebuild.
+	var unlock func()
+	if o.cacheStore != nil {
+		unlock = o.cacheStore.Lock(o.config.Image, cacheKey)
+
+		if id, ok := o.cacheStore.Get(o.config.Image, cacheKey); ok {
+			unlock()
+			o.config.Image = id
+			return true, nil
+		}
+	}
+
+	o.mu.Lock()
+	for _, entry := range o.cache {
+		if entry.parent == o.config.Image && entry.cacheKey == cacheKey {
+			o.config.Image = string(entry.layer)
+			o.mu.Unlock()
+
+			if unlock != nil {
+				unlock()
+			}
+
+			return true, nil
+		}
+	}
+	o.mu.Unlock()
+
+	o.cacheUnlock = unlock
+
+	return false, nil
+}
+
+// CopyToContainer copies a tarred series of files into the rootfs at id.
+func (o *OCI) CopyToContainer(id string, size int64, tr io.Reader) error {
+	return copier.Untar(tr, id)
+}
+
+// CopyFromContainer tars up path from the rootfs at id.
+func (o *OCI) CopyFromContainer(id, path string) (io.Reader, int64, error) {
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copier.Tar(w, filepath.Join(id, path), []string{"."}, copier.Options{}))
+	}()
+
+	return r, -1, nil
+}
+
+// CopyOneFileFromContainer reads a single file out of the current rootfs.
+func (o *OCI) CopyOneFileFromContainer(fn string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(o.current, fn))
+}
+
+// Tag (re)writes the OCI image layout with tag as the index.json manifest's
+// org.opencontainers.image.ref.name annotation. index.json holds a single
+// manifest, so a ref written by an earlier Tag call is replaced, not kept.
+func (o *OCI) Tag(tag string) error {
+	return o.writeIndex(tag)
+}
+
+// Fetch is unimplemented for the oci executor; images are built from
+// scratch or from a pre-populated layer cache, not pulled on demand.
+func (o *OCI) Fetch(name string) (string, error) {
+	return "", fmt.Errorf("oci executor does not support Fetch for %q yet; use the docker executor to seed a base image", name)
+}
+
+// writeIndex (re)writes the OCI image layout under o.imageDir: oci-layout,
+// a blobs/sha256 directory containing the image config blob, the manifest
+// blob, and every layer blob already written by tarLayer, and an
+// index.json pointing at the manifest. ref is recorded as the image's
+// org.opencontainers.image.ref.name annotation.
+func (o *OCI) writeIndex(ref string) error {
+	if o.imageDir == "" {
+		return fmt.Errorf("imageDir is not set; construct OCI with NewOCI(..., imageDir)")
+	}
+
+	blobs := o.blobsDir()
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(o.imageDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+
+	diffIDs := make([]string, len(o.diffIDs))
+	for i, d := range o.diffIDs {
+		diffIDs[i] = "sha256:" + string(d)
+	}
+
+	configContent, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       o.config.ToDocker(o.tty, o.stdin),
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	configDigest, err := writeBlob(blobs, configContent)
+	if err != nil {
+		return err
+	}
+
+	layers := make([]map[string]interface{}, len(o.diffIDs))
+	for i, d := range o.diffIDs {
+		size, err := blobSize(blobs, string(d))
+		if err != nil {
+			return fmt.Errorf("layer blob for diff_id %q was never written: %v", d, err)
+		}
+
+		layers[i] = map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar",
+			"digest":    "sha256:" + string(d),
+			"size":      size,
+		}
+	}
+
+	manifestContent, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    configDigest,
+			"size":      len(configContent),
+		},
+		"layers": layers,
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestDigest, err := writeBlob(blobs, manifestContent)
+	if err != nil {
+		return err
+	}
+
+	index, err := json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifestDigest,
+			"size":      len(manifestContent),
+			"annotations": map[string]string{
+				"org.opencontainers.image.ref.name": ref,
+			},
+		}},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(o.imageDir, "index.json"), index, 0644)
+}
+
+// writeBlob writes content to blobsDir, named by its own sha256 digest, and
+// returns that digest as "sha256:<hex>".
+func writeBlob(blobsDir string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	if err := ioutil.WriteFile(filepath.Join(blobsDir, digest), content, 0644); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + digest, nil
+}
+
+// blobSize returns the size in bytes of the blob already written under
+// blobsDir for the given bare hex digest.
+func blobSize(blobsDir, digest string) (int64, error) {
+	fi, err := os.Stat(filepath.Join(blobsDir, digest))
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
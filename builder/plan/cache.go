@@ -0,0 +1,14 @@
+package plan
+
+import "github.com/erikh/box/builder/cache"
+
+// CacheStore is the plan package's name for the shared cache every stage's
+// Op is handed; it's the same store executor.Executor backends consult
+// directly in CheckCache/Commit via UseCacheStore, so a hit recorded by one
+// side is visible to the other.
+type CacheStore = cache.Store
+
+// NewCacheStore returns an empty, ready-to-use CacheStore.
+func NewCacheStore() *CacheStore {
+	return cache.NewStore()
+}
@@ -0,0 +1,180 @@
+// Package plan builds a box script's stages into a dependency DAG and runs
+// independent stages concurrently, sharing a single content-addressable
+// cache across them. Turning a stage's `run`/`copy`/etc. directives into
+// executable Ops is the mruby builder's job; this package only owns the
+// stage graph, the worker pool, the shared cache, and `--target` pruning.
+package plan
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/erikh/box/builder/executor"
+)
+
+// Op is a single compiled build step, applied to the stage's own cloned
+// executor. deps holds the finished executor for every stage this one
+// names in `import` (for `copy --from=<stage>`), keyed by stage name. cache
+// is shared across every concurrently running stage, so an Op that commits
+// a step should consult and populate it rather than the executor's own
+// (per-instance) cache.
+type Op func(exec executor.Executor, deps map[string]executor.Executor, cache *CacheStore) error
+
+// Stage is one `stage` block of a box script: its base image or parent stage
+// (`from`), the other stages it imports from (`copy --from=<stage>`), and the ops to
+// run against it.
+type Stage struct {
+	Name    string
+	From    string
+	Depends []string
+	Ops     []Op
+
+	// Commands holds the raw, uncompiled directive lines seen for this
+	// stage. The plan parser only needs to know the dependency graph; it
+	// leaves compiling these into Ops to the mruby builder.
+	Commands []string
+}
+
+// Plan is a box script compiled into a stage DAG.
+type Plan struct {
+	Stages map[string]*Stage
+	Order  []string
+}
+
+// NewPlan returns an empty Plan ready to have stages added to it, either
+// via Parse or directly with AddStage.
+func NewPlan() *Plan {
+	return &Plan{Stages: map[string]*Stage{}}
+}
+
+// AddStage registers a new stage, or returns the existing one of the same
+// name so callers can accumulate commands/depends across multiple calls.
+func (p *Plan) AddStage(name, from string) *Stage {
+	if s, ok := p.Stages[name]; ok {
+		return s
+	}
+
+	s := &Stage{Name: name, From: from}
+	p.Stages[name] = s
+	p.Order = append(p.Order, name)
+
+	return s
+}
+
+// DependsOn records that this stage reads from (via `copy --from=`) the
+// named stages.
+func (s *Stage) DependsOn(names ...string) {
+	for _, n := range names {
+		s.Depends = append(s.Depends, n)
+	}
+}
+
+// Parse reads a box script and extracts its stage structure: `stage <name>`
+// begins a stage, `from <ref>` sets its base, and `import <name>` records a
+// dependency on a prior stage -- the subset of syntax needed to build the
+// DAG that Run schedules over. Any other line is recorded verbatim on the
+// current stage's Commands for the mruby builder to compile into Ops.
+func Parse(r io.Reader) (*Plan, error) {
+	p := NewPlan()
+
+	var current *Stage
+	scanner := bufio.NewScanner(r)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "stage":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: `stage` takes exactly one name", lineNo)
+			}
+
+			current = p.AddStage(fields[1], "")
+		case "from":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: `from` outside of a `stage` block", lineNo)
+			}
+
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: `from` takes exactly one image or stage reference", lineNo)
+			}
+
+			current.From = fields[1]
+		case "import":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: `import` outside of a `stage` block", lineNo)
+			}
+
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: `import` takes exactly one stage name", lineNo)
+			}
+
+			current.DependsOn(fields[1])
+		default:
+			if current == nil {
+				return nil, fmt.Errorf("line %d: directive %q outside of a `stage` block", lineNo, fields[0])
+			}
+
+			current.Commands = append(current.Commands, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Target prunes the plan down to target and everything it (transitively)
+// depends on via From or Depends, matching the ergonomics of Dockerfile
+// multi-stage `--target`.
+func (p *Plan) Target(target string) (*Plan, error) {
+	if _, ok := p.Stages[target]; !ok {
+		return nil, fmt.Errorf("no such stage %q", target)
+	}
+
+	keep := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if keep[name] {
+			return
+		}
+
+		s, ok := p.Stages[name]
+		if !ok {
+			return // external base image, not a stage
+		}
+
+		keep[name] = true
+
+		if s.From != "" {
+			visit(s.From)
+		}
+
+		for _, d := range s.Depends {
+			visit(d)
+		}
+	}
+
+	visit(target)
+
+	pruned := NewPlan()
+	for _, name := range p.Order {
+		if keep[name] {
+			pruned.Stages[name] = p.Stages[name]
+			pruned.Order = append(pruned.Order, name)
+		}
+	}
+
+	return pruned, nil
+}
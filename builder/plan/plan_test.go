@@ -0,0 +1,54 @@
+package plan
+
+import (
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type planSuite struct{}
+
+var _ = Suite(&planSuite{})
+
+func TestPlan(t *T) {
+	TestingT(t)
+}
+
+const testScript = `
+stage base
+from busybox
+run echo base
+
+stage app
+from base
+import base
+copy . /app
+`
+
+func (s *planSuite) TestParse(c *C) {
+	p, err := Parse(strings.NewReader(testScript))
+	c.Assert(err, IsNil)
+	c.Assert(p.Order, DeepEquals, []string{"base", "app"})
+
+	base := p.Stages["base"]
+	c.Assert(base.From, Equals, "busybox")
+	c.Assert(base.Commands, DeepEquals, []string{"run echo base"})
+
+	app := p.Stages["app"]
+	c.Assert(app.From, Equals, "base")
+	c.Assert(app.Depends, DeepEquals, []string{"base"})
+	c.Assert(app.Commands, DeepEquals, []string{"copy . /app"})
+}
+
+func (s *planSuite) TestTarget(c *C) {
+	p, err := Parse(strings.NewReader(testScript))
+	c.Assert(err, IsNil)
+
+	pruned, err := p.Target("base")
+	c.Assert(err, IsNil)
+	c.Assert(pruned.Order, DeepEquals, []string{"base"})
+
+	_, err = p.Target("nonexistent")
+	c.Assert(err, NotNil)
+}
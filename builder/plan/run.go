@@ -0,0 +1,170 @@
+package plan
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/erikh/box/builder/cache"
+	"github.com/erikh/box/builder/executor"
+)
+
+// Cloner is implemented by executor.Executor backends (Docker, OCI) that
+// support running independent, concurrent build stages: Clone returns a
+// fresh instance with its own *config.Config so concurrent stages don't
+// clobber each other's in-progress image state.
+type Cloner interface {
+	executor.Executor
+	Clone() (executor.Executor, error)
+}
+
+// cacheStoreUser is implemented by executor.Executor backends (Docker, OCI)
+// that consult a shared cache.Store directly from CheckCache/Commit. Run
+// sets it on every stage's cloned executor so stages sharing a parent image
+// reuse one another's committed steps instead of racing to rebuild them.
+type cacheStoreUser interface {
+	UseCacheStore(*cache.Store)
+}
+
+// Runner executes a Plan's stages concurrently, respecting the From/Depends
+// edges between them.
+type Runner struct {
+	Plan  *Plan
+	Cache *CacheStore
+	// Jobs caps how many stages run at once. 0 means GOMAXPROCS, matching
+	// a `--jobs` flag defaulting to the number of available cores.
+	Jobs int
+}
+
+// Run builds every stage in r.Plan, giving each stage its own clone -- of
+// base, or of the parent stage's finished executor when From names a stage
+// -- so they can proceed independently. It blocks until every stage has
+// finished; once a stage fails, stages not yet started are skipped, and the
+// first error is returned.
+func (r *Runner) Run(base Cloner) error {
+	jobs := r.Jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+
+	cacheStore := r.Cache
+	if cacheStore == nil {
+		cacheStore = NewCacheStore()
+	}
+
+	sem := make(chan struct{}, jobs)
+
+	done := make(map[string]chan struct{}, len(r.Plan.Stages))
+	for name := range r.Plan.Stages {
+		done[name] = make(chan struct{})
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		results  = map[string]executor.Executor{}
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	record := func(name string, exec executor.Executor) {
+		mu.Lock()
+		results[name] = exec
+		mu.Unlock()
+	}
+
+	result := func(name string) (executor.Executor, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		exec, ok := results[name]
+		return exec, ok
+	}
+
+	for _, name := range r.Plan.Order {
+		stage := r.Plan.Stages[name]
+
+		wg.Add(1)
+		go func(stage *Stage) {
+			defer wg.Done()
+			defer close(done[stage.Name])
+
+			for _, dep := range dependencies(stage) {
+				if ch, ok := done[dep]; ok {
+					<-ch
+				}
+			}
+
+			if failed() {
+				return
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			parent := base
+			if fromExec, ok := result(stage.From); ok {
+				fromCloner, ok := fromExec.(Cloner)
+				if !ok {
+					fail(fmt.Errorf("stage %q: parent stage %q's executor does not support cloning", stage.Name, stage.From))
+					return
+				}
+				parent = fromCloner
+			}
+
+			stageExec, err := parent.Clone()
+			if err != nil {
+				fail(fmt.Errorf("stage %q: %v", stage.Name, err))
+				return
+			}
+
+			if user, ok := stageExec.(cacheStoreUser); ok {
+				user.UseCacheStore(cacheStore)
+			}
+
+			deps := make(map[string]executor.Executor, len(stage.Depends))
+			for _, dep := range stage.Depends {
+				if depExec, ok := result(dep); ok {
+					deps[dep] = depExec
+				}
+			}
+
+			for _, op := range stage.Ops {
+				if err := op(stageExec, deps, cacheStore); err != nil {
+					fail(fmt.Errorf("stage %q: %v", stage.Name, err))
+					return
+				}
+			}
+
+			record(stage.Name, stageExec)
+		}(stage)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// dependencies returns the names this stage may wait on: its From (if set)
+// plus whatever it imports from. A From naming an external image rather than
+// a stage has no entry in Run's done map, so Run does not wait on it.
+func dependencies(s *Stage) []string {
+	deps := s.Depends
+	if s.From != "" {
+		deps = append([]string{s.From}, deps...)
+	}
+
+	return deps
+}
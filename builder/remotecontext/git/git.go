@@ -0,0 +1,246 @@
+// Package git resolves a git remote (as used by the mruby `import`/`copy`
+// verbs, e.g. "git://host/repo.git#branch:subdir" or
+// "https://host/repo.git#ref") into a local directory that the existing
+// layer/copier machinery can treat like any other build context.
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Context is a git remote checked out to a local, temporary directory.
+type Context struct {
+	dir    string
+	subdir string
+}
+
+// Root returns the effective build root: the clone directory, joined with
+// the #fragment's ":subdir" portion if one was given.
+func (c *Context) Root() string {
+	if c.subdir == "" {
+		return c.dir
+	}
+
+	return filepath.Join(c.dir, c.subdir)
+}
+
+// Close removes the clone from disk.
+func (c *Context) Close() error {
+	unregister(c)
+	return os.RemoveAll(c.dir)
+}
+
+// AuthProvider supplies credentials for a git remote out of band, so that
+// Fetch never has to be handed a URL with embedded user/password.
+type AuthProvider interface {
+	// Env returns additional environment variables to set on the git
+	// subprocess, e.g. GIT_SSH_COMMAND or GIT_ASKPASS.
+	Env() ([]string, error)
+}
+
+// NetrcAuth defers to whatever credentials the user already has in
+// ~/.netrc; it sets no extra environment.
+type NetrcAuth struct{}
+
+// Env implements AuthProvider.
+func (NetrcAuth) Env() ([]string, error) { return nil, nil }
+
+// SSHAgentAuth defers to a running ssh-agent via the inherited
+// SSH_AUTH_SOCK; it sets no extra environment either, beyond making sure
+// BatchMode is on so a misconfigured agent fails fast instead of prompting.
+type SSHAgentAuth struct{}
+
+// Env implements AuthProvider.
+func (SSHAgentAuth) Env() ([]string, error) {
+	return []string{"GIT_SSH_COMMAND=ssh -o BatchMode=yes"}, nil
+}
+
+// AskPassAuth shells out to an external GIT_ASKPASS helper for credentials,
+// e.g. a script backed by a secret store.
+type AskPassAuth struct {
+	Command string
+}
+
+// Env implements AuthProvider.
+func (a AskPassAuth) Env() ([]string, error) {
+	if a.Command == "" {
+		return nil, fmt.Errorf("AskPassAuth: Command may not be empty")
+	}
+
+	return []string{"GIT_ASKPASS=" + a.Command}, nil
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[*Context]struct{}{}
+)
+
+func register(c *Context) {
+	registryMu.Lock()
+	registry[c] = struct{}{}
+	registryMu.Unlock()
+}
+
+func unregister(c *Context) {
+	registryMu.Lock()
+	delete(registry, c)
+	registryMu.Unlock()
+}
+
+// CleanupAll removes every clone still outstanding. The builder calls this
+// on shutdown so stray temp directories don't accumulate across runs.
+func CleanupAll() error {
+	registryMu.Lock()
+	contexts := make([]*Context, 0, len(registry))
+	for c := range registry {
+		contexts = append(contexts, c)
+	}
+	registryMu.Unlock()
+
+	var firstErr error
+	for _, c := range contexts {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Fetch clones raw -- a URL optionally suffixed with "#fragment", where
+// fragment is "ref" or "ref:subdir" -- into a fresh temp directory. The
+// clone is shallow and single-branch when ref looks like a branch or tag;
+// if that fails (ref turned out to be a commit SHA, or the server doesn't
+// support shallow fetches of arbitrary refs), Fetch falls back to a full
+// clone followed by an explicit checkout.
+func Fetch(raw string, auth AuthProvider) (*Context, error) {
+	repoURL, ref, subdir, err := parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		auth = NetrcAuth{}
+	}
+
+	env, err := auth.Env()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := containedSubdir(subdir); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "box-git-context")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := shallowClone(repoURL, ref, dir, env); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	c := &Context{dir: dir, subdir: subdir}
+	register(c)
+
+	return c, nil
+}
+
+// containedSubdir rejects a #fragment ":subdir" that would resolve outside
+// the clone directory, the same ".." traversal copier.Untar guards against
+// for tar entries (e.g. "branch:../../etc" must not make Root() point
+// outside the temporary clone).
+func containedSubdir(subdir string) error {
+	if subdir == "" {
+		return nil
+	}
+
+	clean := filepath.Clean(subdir)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("subdir %q escapes the clone directory", subdir)
+	}
+
+	return nil
+}
+
+// parse splits "url#ref:subdir" into its three parts. Both the fragment
+// and the subdir within it are optional.
+func parse(raw string) (repoURL, ref, subdir string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	fragment := u.Fragment
+	u.Fragment = ""
+	repoURL = u.String()
+
+	if fragment == "" {
+		return repoURL, "", "", nil
+	}
+
+	parts := strings.SplitN(fragment, ":", 2)
+	ref = parts[0]
+	if len(parts) == 2 {
+		subdir = parts[1]
+	}
+
+	return repoURL, ref, subdir, nil
+}
+
+// shallowClone attempts `git clone --depth 1 --single-branch [--branch
+// ref]`, falling back to a full clone plus checkout if ref isn't resolvable
+// as a branch/tag (e.g. it's a bare commit SHA).
+func shallowClone(repoURL, ref, dir string, env []string) error {
+	args := []string{"clone", "--depth", "1", "--single-branch"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	// "--" stops git from parsing repoURL as a flag: an attacker-controlled
+	// import/copy source beginning with "-" would otherwise be read as an
+	// option rather than a positional repo argument.
+	args = append(args, "--", repoURL, dir)
+
+	if err := runGit(env, "", args...); err == nil {
+		return nil
+	}
+
+	if ref == "" {
+		return fmt.Errorf("git clone of %q failed", repoURL)
+	}
+
+	if err := runGit(env, "", "clone", "--", repoURL, dir); err != nil {
+		return err
+	}
+
+	// ref goes before "--" so git reads it as a revision rather than a
+	// pathspec; a leading "-" is rejected so it can't be read as an option.
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid git ref %q", ref)
+	}
+
+	return runGit(env, dir, "checkout", ref, "--")
+}
+
+func runGit(env []string, dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %v", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type gitSuite struct{}
+
+var _ = Suite(&gitSuite{})
+
+func TestGit(t *T) {
+	TestingT(t)
+}
+
+func (s *gitSuite) TestParseURLOnly(c *C) {
+	repoURL, ref, subdir, err := parse("https://host/repo.git")
+	c.Assert(err, IsNil)
+	c.Assert(repoURL, Equals, "https://host/repo.git")
+	c.Assert(ref, Equals, "")
+	c.Assert(subdir, Equals, "")
+}
+
+func (s *gitSuite) TestParseRefOnly(c *C) {
+	repoURL, ref, subdir, err := parse("https://host/repo.git#v1.2.3")
+	c.Assert(err, IsNil)
+	c.Assert(repoURL, Equals, "https://host/repo.git")
+	c.Assert(ref, Equals, "v1.2.3")
+	c.Assert(subdir, Equals, "")
+}
+
+func (s *gitSuite) TestParseRefAndSubdir(c *C) {
+	repoURL, ref, subdir, err := parse("git://host/repo.git#branch:sub/dir")
+	c.Assert(err, IsNil)
+	c.Assert(repoURL, Equals, "git://host/repo.git")
+	c.Assert(ref, Equals, "branch")
+	c.Assert(subdir, Equals, "sub/dir")
+}
+
+func (s *gitSuite) TestParseSubdirWithColon(c *C) {
+	repoURL, ref, subdir, err := parse("https://host/repo.git#ref:sub:dir")
+	c.Assert(err, IsNil)
+	c.Assert(repoURL, Equals, "https://host/repo.git")
+	c.Assert(ref, Equals, "ref")
+	c.Assert(subdir, Equals, "sub:dir")
+}
+
+func (s *gitSuite) TestAskPassAuthRequiresCommand(c *C) {
+	_, err := AskPassAuth{}.Env()
+	c.Assert(err, NotNil)
+}
+
+func (s *gitSuite) TestAskPassAuthEnv(c *C) {
+	env, err := AskPassAuth{Command: "/bin/askpass"}.Env()
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, []string{"GIT_ASKPASS=/bin/askpass"})
+}
+
+func (s *gitSuite) TestRegisterUnregisterCleanup(c *C) {
+	ctx := &Context{dir: c.MkDir()}
+	register(ctx)
+
+	registryMu.Lock()
+	_, ok := registry[ctx]
+	registryMu.Unlock()
+	c.Assert(ok, Equals, true)
+
+	c.Assert(CleanupAll(), IsNil)
+
+	registryMu.Lock()
+	_, ok = registry[ctx]
+	registryMu.Unlock()
+	c.Assert(ok, Equals, false)
+}
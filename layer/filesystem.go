@@ -2,18 +2,39 @@ package layer
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
+// MountMode selects how Filesystem.Mount assembles the overlay: the
+// kernel's native overlay driver, the unprivileged fuse-overlayfs binary, or
+// whichever of the two is usable.
+type MountMode int
+
+const (
+	// MountModeAuto uses the kernel overlay driver when running as root
+	// and the kernel supports it, falling back to fuse-overlayfs
+	// otherwise. This is the zero value, and the default.
+	MountModeAuto MountMode = iota
+	// MountModeKernel forces the kernel's native overlay driver.
+	MountModeKernel
+	// MountModeFuseOverlayfs forces fuse-overlayfs, which works inside
+	// unprivileged user namespaces where the kernel driver does not.
+	MountModeFuseOverlayfs
+)
+
 // Filesystem encapsulates a fully mounted filesystem. It is manipulated by
 // adding layers and unmounting (and remounting) the product.
 type Filesystem struct {
 	Layers     []*Layer
 	Mountpoint string
+	MountMode  MountMode
 	workDir    string
+	fuseCmd    *exec.Cmd
 }
 
 // Mount creates any missing layers and mounts the filesystem.
@@ -47,11 +68,97 @@ func (f *Filesystem) Mount(work string) error {
 
 	lowerStrs := []string{}
 	for _, layer := range lower {
-		lowerStrs = append(lowerStrs, layer.Path())
+		lowerStrs = append(lowerStrs, escapeOverlayPath(layer.Path()))
 	}
 
-	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerStrs, ":"), upper.Path(), work)
-	fmt.Println(data)
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerStrs, ":"), escapeOverlayPath(upper.Path()), escapeOverlayPath(work))
+
+	if f.useFuse() {
+		return f.mountFuse(data)
+	}
 
 	return unix.Mount("overlay", f.Mountpoint, "overlay", 0, data)
 }
+
+// Unmount tears down the filesystem. If the mount was backed by a
+// fuse-overlayfs child process, it is terminated; otherwise the kernel
+// overlay mount is unmounted directly.
+func (f *Filesystem) Unmount() error {
+	if f.fuseCmd != nil {
+		err := unix.Unmount(f.Mountpoint, 0)
+		if err != nil && f.fuseCmd.Process != nil {
+			f.fuseCmd.Process.Kill()
+		}
+
+		waitErr := f.fuseCmd.Wait()
+		f.fuseCmd = nil
+
+		if err != nil {
+			return err
+		}
+		return waitErr
+	}
+
+	return unix.Unmount(f.Mountpoint, 0)
+}
+
+// Exists returns true if the filesystem's mountpoint has been created.
+func (f *Filesystem) Exists() bool {
+	_, err := os.Stat(f.Mountpoint)
+	return err == nil
+}
+
+// Path returns the fully-qualified mountpoint of the filesystem.
+func (f *Filesystem) Path() string {
+	return f.Mountpoint
+}
+
+// useFuse decides, according to MountMode, whether fuse-overlayfs should be
+// used in place of the kernel driver.
+func (f *Filesystem) useFuse() bool {
+	switch f.MountMode {
+	case MountModeFuseOverlayfs:
+		return true
+	case MountModeKernel:
+		return false
+	default:
+		return os.Geteuid() != 0 || !kernelOverlaySupported()
+	}
+}
+
+// mountFuse shells out to fuse-overlayfs with the same lowerdir/upperdir/
+// workdir options the kernel driver would take, keeping the child process
+// around so Unmount can terminate it.
+func (f *Filesystem) mountFuse(options string) error {
+	cmd := exec.Command("fuse-overlayfs", "-o", options, f.Mountpoint)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Could not start fuse-overlayfs: %v", err)
+	}
+
+	f.fuseCmd = cmd
+
+	return nil
+}
+
+// kernelOverlaySupported does a best-effort check of whether the running
+// kernel has the overlay filesystem driver available.
+func kernelOverlaySupported() bool {
+	content, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(content), "overlay")
+}
+
+// escapeOverlayPath escapes the characters the kernel overlay mount option
+// parser treats specially -- ':' separates lowerdir entries and ','
+// separates mount options -- so layer paths containing them survive
+// round-tripping through the combined options string.
+func escapeOverlayPath(path string) string {
+	r := strings.NewReplacer(`\`, `\\`, `:`, `\:`, `,`, `\,`)
+	return r.Replace(path)
+}
@@ -0,0 +1,99 @@
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type filesystemSuite struct{}
+
+var _ = Suite(&filesystemSuite{})
+
+func TestFilesystem(t *T) {
+	TestingT(t)
+}
+
+func (s *filesystemSuite) TestEscapeOverlayPath(c *C) {
+	table := []struct{ in, out string }{
+		{"/var/lib/box/layers/abc", "/var/lib/box/layers/abc"},
+		{"/var/lib/box,layers", `/var/lib/box\,layers`},
+		{"/var/lib/box:layers", `/var/lib/box\:layers`},
+		{`/var/lib/box\layers`, `/var/lib/box\\layers`},
+		{"a:b,c", `a\:b\,c`},
+	}
+
+	for i, check := range table {
+		comment := Commentf("Index: %d", i)
+		c.Assert(escapeOverlayPath(check.in), Equals, check.out, comment)
+	}
+}
+
+func (s *filesystemSuite) TestUseFuseForcedKernel(c *C) {
+	f := &Filesystem{MountMode: MountModeKernel}
+	c.Assert(f.useFuse(), Equals, false)
+}
+
+func (s *filesystemSuite) TestUseFuseForcedFuseOverlayfs(c *C) {
+	f := &Filesystem{MountMode: MountModeFuseOverlayfs}
+	c.Assert(f.useFuse(), Equals, true)
+}
+
+// TestUseFuseAutoNonRoot asserts that MountModeAuto (the zero value) always
+// selects fuse-overlayfs when not running as root, regardless of kernel
+// support, since the kernel driver requires privileges this process doesn't
+// have.
+func (s *filesystemSuite) TestUseFuseAutoNonRoot(c *C) {
+	if os.Geteuid() == 0 {
+		c.Skip("test must not run as root")
+	}
+
+	f := &Filesystem{}
+	c.Assert(f.MountMode, Equals, MountModeAuto)
+	c.Assert(f.useFuse(), Equals, true)
+}
+
+func (s *filesystemSuite) TestExistsAndPath(c *C) {
+	dir, err := ioutil.TempDir("", "box-filesystem-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	f := &Filesystem{Mountpoint: dir}
+	c.Assert(f.Exists(), Equals, true)
+	c.Assert(f.Path(), Equals, dir)
+
+	missing := &Filesystem{Mountpoint: dir + "-missing"}
+	c.Assert(missing.Exists(), Equals, false)
+}
+
+func (s *filesystemSuite) TestMountRequiresTwoLayers(c *C) {
+	dir, err := ioutil.TempDir("", "box-filesystem-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	l, err := New("single", dir)
+	c.Assert(err, IsNil)
+
+	f := &Filesystem{Layers: []*Layer{l}, Mountpoint: dir}
+	err = f.Mount("")
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*Minimum 2 layers.*")
+}
+
+func (s *filesystemSuite) TestMountRequiresWorkdir(c *C) {
+	dir, err := ioutil.TempDir("", "box-filesystem-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	a, err := New("a", dir)
+	c.Assert(err, IsNil)
+	b, err := New("b", dir)
+	c.Assert(err, IsNil)
+
+	f := &Filesystem{Layers: []*Layer{a, b}, Mountpoint: dir}
+	err = f.Mount("")
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*workdir cannot be empty.*")
+}
@@ -80,3 +80,15 @@ func (l *Layer) Create() error {
 func (l *Layer) Remove() error {
 	return l.inChdir(func(l *Layer) error { return os.RemoveAll(l.qualified()) })
 }
+
+// Exists returns true if the layer's directory has already been created on
+// disk.
+func (l *Layer) Exists() bool {
+	_, err := os.Stat(l.qualified())
+	return err == nil
+}
+
+// Path returns the fully-qualified, on-disk path of the layer.
+func (l *Layer) Path() string {
+	return l.qualified()
+}